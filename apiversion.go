@@ -0,0 +1,92 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// dockerDistributionAPIVersionHeader is set by registries implementing
+// the Docker/OCI distribution spec, advertising the API versions they
+// support as a space-separated list of type/version tokens, e.g.
+// "registry/2.0".
+const dockerDistributionAPIVersionHeader = "Docker-Distribution-API-Version"
+
+// APIVersion identifies a single type/version token advertised by a
+// registry, e.g. {Type: "registry", Version: "2.0"}.
+type APIVersion struct {
+	Type    string
+	Version string
+}
+
+// String renders the APIVersion back into its wire form, "type/version".
+func (v APIVersion) String() string {
+	return fmt.Sprintf("%s/%s", v.Type, v.Version)
+}
+
+// APIVersions parses every token carried by header (there may be
+// several values, and each value may itself be space-separated) off of
+// resp, returning the ones that parse as "type/version".
+func APIVersions(resp *http.Response, header string) []APIVersion {
+	var versions []APIVersion
+	for _, value := range resp.Header[http.CanonicalHeaderKey(header)] {
+		for _, token := range strings.Fields(value) {
+			typ, version, ok := strings.Cut(token, "/")
+			if !ok {
+				continue
+			}
+			versions = append(versions, APIVersion{Type: typ, Version: version})
+		}
+	}
+	return versions
+}
+
+// checkAPIVersion probes /v2/ and confirms the registry advertises a
+// registry/2.x API version, caching the result on r so repeated calls
+// (e.g. during a manifest-list copy) don't re-probe. It fails fast,
+// with a clear error, against anything that doesn't advertise
+// registry/2.x - including a registry that omits the version header
+// entirely - rather than letting callers chase confusing 404s against
+// a non-registry (or v1-only) endpoint.
+func (r *Registry) checkAPIVersion() error {
+	if r.apiVersionChecked {
+		return nil
+	}
+
+	pingUrl := r.url("/v2/")
+	req, err := r.newRequest("GET", pingUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return HttpError{resp.Status, pingUrl}
+	}
+
+	versions := APIVersions(resp, dockerDistributionAPIVersionHeader)
+	if len(versions) == 0 {
+		return fmt.Errorf("%s did not send a %s header; cannot confirm a registry/2.x API", r.URL, dockerDistributionAPIVersionHeader)
+	}
+
+	for _, v := range versions {
+		if v.Type == "registry" && strings.HasPrefix(v.Version, "2.") {
+			r.apiVersionChecked = true
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s does not advertise a registry/2.x API version (got %v)", r.URL, versions)
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestAPIVersions(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   []APIVersion
+	}{
+		{
+			name:   "single value",
+			header: http.Header{"Docker-Distribution-Api-Version": []string{"registry/2.0"}},
+			want:   []APIVersion{{Type: "registry", Version: "2.0"}},
+		},
+		{
+			name:   "space-separated tokens in one value",
+			header: http.Header{"Docker-Distribution-Api-Version": []string{"registry/2.0 registry/2.1"}},
+			want: []APIVersion{
+				{Type: "registry", Version: "2.0"},
+				{Type: "registry", Version: "2.1"},
+			},
+		},
+		{
+			name:   "multiple header values",
+			header: http.Header{"Docker-Distribution-Api-Version": []string{"registry/2.0", "registry/2.1"}},
+			want: []APIVersion{
+				{Type: "registry", Version: "2.0"},
+				{Type: "registry", Version: "2.1"},
+			},
+		},
+		{
+			name:   "header absent",
+			header: http.Header{},
+			want:   nil,
+		},
+		{
+			name:   "token without a slash is skipped",
+			header: http.Header{"Docker-Distribution-Api-Version": []string{"garbage registry/2.0"}},
+			want:   []APIVersion{{Type: "registry", Version: "2.0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: tt.header}
+			got := APIVersions(resp, dockerDistributionAPIVersionHeader)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("APIVersions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIVersionString(t *testing.T) {
+	v := APIVersion{Type: "registry", Version: "2.0"}
+	if got, want := v.String(), "registry/2.0"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
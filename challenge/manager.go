@@ -0,0 +1,115 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+// Package challenge caches the bearer-auth challenges and tokens a
+// registry hands out, so a client that issues many requests against the
+// same registry (e.g. while walking a manifest list) only has to
+// authenticate once per (service, scope) pair instead of on every
+// single 401.
+package challenge
+
+import (
+	"sync"
+	"time"
+)
+
+// refreshSkew is how far ahead of a token's actual expiry it is treated
+// as stale, so a request doesn't race a token expiring mid-flight.
+const refreshSkew = 30 * time.Second
+
+// Challenge is the bearer challenge (RFC 6750 "WWW-Authenticate:
+// Bearer") a registry endpoint responded with.
+type Challenge struct {
+	Realm   string
+	Service string
+	Scope   string
+}
+
+// tokenEntry caches a single (service, scope) token. It carries its own
+// mutex so concurrent requests needing the same token serialize on
+// fetching it once, rather than each issuing their own auth round trip.
+type tokenEntry struct {
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (e *tokenEntry) validFor(now time.Time) bool {
+	return e.token != "" && now.Add(refreshSkew).Before(e.expiresAt)
+}
+
+// Manager caches bearer challenges per endpoint and bearer tokens per
+// (service, scope), so a Transport can preemptively attach a token
+// instead of always eating a 401 first.
+type Manager struct {
+	mu         sync.Mutex
+	challenges map[string]Challenge
+	tokens     map[string]*tokenEntry
+}
+
+// NewManager returns an empty Manager.
+func NewManager() *Manager {
+	return &Manager{
+		challenges: make(map[string]Challenge),
+		tokens:     make(map[string]*tokenEntry),
+	}
+}
+
+// Record remembers challenge as the one most recently presented by
+// endpoint (typically scheme+host+port+path-prefix), so later requests
+// to the same endpoint can skip straight to token acquisition.
+func (m *Manager) Record(endpoint string, c Challenge) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.challenges[endpoint] = c
+}
+
+// ChallengeFor returns the last Challenge recorded for endpoint, if any.
+func (m *Manager) ChallengeFor(endpoint string) (Challenge, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.challenges[endpoint]
+	return c, ok
+}
+
+// Token returns a cached, still-valid token for (service, scope),
+// fetching (and caching) a fresh one via fetch if none is cached or the
+// cached one is within refreshSkew of expiring. Concurrent calls for the
+// same (service, scope) serialize on a per-entry mutex, so only one of
+// them actually calls fetch. fetch returns the absolute time the token
+// expires at, not a duration from now.
+func (m *Manager) Token(service, scope string, fetch func() (token string, expiresAt time.Time, err error)) (string, error) {
+	entry := m.entryFor(service, scope)
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.validFor(time.Now()) {
+		return entry.token, nil
+	}
+
+	token, expiresAt, err := fetch()
+	if err != nil {
+		return "", err
+	}
+
+	entry.token = token
+	entry.expiresAt = expiresAt
+
+	return token, nil
+}
+
+func (m *Manager) entryFor(service, scope string) *tokenEntry {
+	key := service + "\x00" + scope
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.tokens[key]
+	if !ok {
+		entry = &tokenEntry{}
+		m.tokens[key] = entry
+	}
+	return entry
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package challenge
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManagerRecordAndChallengeFor(t *testing.T) {
+	m := NewManager()
+
+	if _, ok := m.ChallengeFor("https://registry.example.com"); ok {
+		t.Fatalf("ChallengeFor() on an empty Manager reported a hit")
+	}
+
+	c := Challenge{Realm: "https://auth.example.com/token", Service: "registry.example.com", Scope: "repository:foo:pull"}
+	m.Record("https://registry.example.com", c)
+
+	got, ok := m.ChallengeFor("https://registry.example.com")
+	if !ok || got != c {
+		t.Errorf("ChallengeFor() = %+v, %v, want %+v, true", got, ok, c)
+	}
+}
+
+func TestManagerTokenCachesUntilExpiry(t *testing.T) {
+	m := NewManager()
+	var fetches int32
+
+	fetch := func() (string, time.Time, error) {
+		atomic.AddInt32(&fetches, 1)
+		return "tok", time.Now().Add(time.Hour), nil
+	}
+
+	for i := 0; i < 3; i++ {
+		token, err := m.Token("service", "scope", fetch)
+		if err != nil {
+			t.Fatalf("Token() error = %v", err)
+		}
+		if token != "tok" {
+			t.Errorf("Token() = %q, want %q", token, "tok")
+		}
+	}
+
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("fetch called %d times, want 1", got)
+	}
+}
+
+func TestManagerTokenRefreshesWithinSkew(t *testing.T) {
+	m := NewManager()
+	var fetches int32
+
+	// Expires well inside refreshSkew, so every call should refetch
+	// rather than reuse a token that's about to go stale mid-flight.
+	fetch := func() (string, time.Time, error) {
+		atomic.AddInt32(&fetches, 1)
+		return "tok", time.Now().Add(refreshSkew / 2), nil
+	}
+
+	if _, err := m.Token("service", "scope", fetch); err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	if _, err := m.Token("service", "scope", fetch); err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+
+	if got := atomic.LoadInt32(&fetches); got != 2 {
+		t.Errorf("fetch called %d times, want 2", got)
+	}
+}
+
+func TestManagerTokenConcurrentFetchesDeduplicate(t *testing.T) {
+	m := NewManager()
+	var fetches int32
+
+	fetch := func() (string, time.Time, error) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(10 * time.Millisecond)
+		return "tok", time.Now().Add(time.Hour), nil
+	}
+
+	const goroutines = 20
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			if _, err := m.Token("service", "scope", fetch); err != nil {
+				t.Errorf("Token() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("fetch called %d times, want 1", got)
+	}
+}
+
+func TestManagerTokenSeparateScopesDoNotShareEntries(t *testing.T) {
+	m := NewManager()
+	var fetches int32
+
+	fetch := func() (string, time.Time, error) {
+		n := atomic.AddInt32(&fetches, 1)
+		if n == 1 {
+			return "tok-a", time.Now().Add(time.Hour), nil
+		}
+		return "tok-b", time.Now().Add(time.Hour), nil
+	}
+
+	a, err := m.Token("service", "repository:a:pull", fetch)
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	b, err := m.Token("service", "repository:b:pull", fetch)
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+
+	if a == b {
+		t.Errorf("Token() for distinct scopes returned the same token %q", a)
+	}
+	if got := atomic.LoadInt32(&fetches); got != 2 {
+		t.Errorf("fetch called %d times, want 2", got)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// descriptor mirrors the OCI/Docker content descriptor fields we care
+// about when walking a manifest or manifest list.
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// manifest mirrors the subset of an OCI image manifest / Docker v2
+// manifest that references the blobs it is made of.
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        *descriptor  `json:"config,omitempty"`
+	Layers        []descriptor `json:"layers,omitempty"`
+}
+
+// manifestIndex mirrors an OCI image index / Docker manifest list.
+type manifestIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []indexEntry      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// indexEntry is a single manifest-list entry. It keeps the entry's raw
+// JSON alongside the descriptor fields we actually act on (Digest, to
+// walk/copy the child, and Platform, to filter by --platform), so
+// re-marshaling a manifestIndex after filtering reproduces every kept
+// entry byte-for-byte, including descriptor/platform fields we don't
+// model (annotations, urls, os.version, os.features, ...).
+type indexEntry struct {
+	descriptor
+	raw json.RawMessage
+}
+
+func (e *indexEntry) UnmarshalJSON(data []byte) error {
+	e.raw = append(json.RawMessage(nil), data...)
+	return json.Unmarshal(data, &e.descriptor)
+}
+
+func (e indexEntry) MarshalJSON() ([]byte, error) {
+	return e.raw, nil
+}
+
+func isManifestList(mediaType string) bool {
+	return mediaType == dockerManifestListV2MIME || mediaType == ociIndexV1MIME
+}
+
+// Copy pulls the manifest (and, transitively, every blob and child
+// manifest it references) identified by srcRepo:srcTag out of r, and
+// pushes it into dst under dstRepo:dstTag. Unlike ReTag, src and dst may
+// be different registries entirely.
+func (r *Registry) Copy(srcRepo, srcTag string, dst *Registry, dstRepo, dstTag string) error {
+	body, mediaType, err := r.getManifest(srcRepo, srcTag)
+	if err != nil {
+		return err
+	}
+
+	if err := r.copyManifestBlobs(srcRepo, dst, dstRepo, body, mediaType); err != nil {
+		return err
+	}
+
+	return dst.putManifest(dstRepo, dstTag, body, mediaType)
+}
+
+// copyManifestBlobs ensures every blob referenced by body (a manifest or
+// manifest index of the given mediaType) exists in dst, recursing into
+// child manifests of an index first.
+func (r *Registry) copyManifestBlobs(srcRepo string, dst *Registry, dstRepo string, body []byte, mediaType string) error {
+	if isManifestList(mediaType) {
+		var index manifestIndex
+		if err := json.Unmarshal(body, &index); err != nil {
+			return fmt.Errorf("decoding manifest index: %w", err)
+		}
+		for _, child := range index.Manifests {
+			childBody, childMediaType, err := r.getManifest(srcRepo, child.Digest)
+			if err != nil {
+				return err
+			}
+			if err := r.copyManifestBlobs(srcRepo, dst, dstRepo, childBody, childMediaType); err != nil {
+				return err
+			}
+			if err := dst.putManifest(dstRepo, child.Digest, childBody, childMediaType); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return fmt.Errorf("decoding manifest: %w", err)
+	}
+
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, blob := range blobs {
+		if err := r.copyBlob(srcRepo, dst, dstRepo, blob.Digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyBlob makes the blob identified by digest available in dstRepo on
+// dst, first attempting a cross-repository mount and falling back to
+// streaming the blob through this process when the mount is refused.
+func (r *Registry) copyBlob(srcRepo string, dst *Registry, dstRepo, digest string) error {
+	if ok, err := dst.blobExists(dstRepo, digest); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	mounted, err := dst.mountBlob(dstRepo, srcRepo, digest)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+
+	return r.streamBlob(srcRepo, dst, dstRepo, digest)
+}
+
+func (r *Registry) blobExists(repo, digest string) (bool, error) {
+	headUrl := r.url("/v2/%s/blobs/%s", repo, digest)
+	req, err := r.newRequest("HEAD", headUrl, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// mountBlob attempts a cross-repository blob mount of digest from
+// fromRepo into repo, without streaming any blob content through us. It
+// reports whether the mount succeeded; a false result (with a nil error)
+// means the registry declined the mount and the blob must be streamed.
+func (r *Registry) mountBlob(repo, fromRepo, digest string) (bool, error) {
+	mountUrl := r.url("/v2/%s/blobs/uploads/?mount=%s&from=%s", repo, digest, fromRepo)
+	req, err := r.newRequest("POST", mountUrl, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		// The registry started an upload session instead of mounting
+		// (it doesn't have the source blob, or mount isn't supported
+		// across these two repositories). Abandon the session; the
+		// caller will stream the blob through a fresh upload.
+		return false, nil
+	default:
+		return false, nil
+	}
+}
+
+// fetchBlob issues a fresh GET against getUrl, returning its body and
+// Content-Length on a 200 response. It's used both for streamBlob's
+// initial download and, via PATCH's GetBody, to re-download the blob
+// if a retry needs to replay it.
+func (r *Registry) fetchBlob(getUrl string) (io.ReadCloser, int64, error) {
+	req, err := r.newRequest("GET", getUrl, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, 0, HttpError{resp.Status, getUrl}
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// streamBlob downloads digest from srcRepo on r and uploads it to
+// dstRepo on dst via a chunked PATCH followed by a finalizing PUT.
+func (r *Registry) streamBlob(srcRepo string, dst *Registry, dstRepo, digest string) error {
+	getUrl := r.url("/v2/%s/blobs/%s", srcRepo, digest)
+	getBody, contentLength, err := r.fetchBlob(getUrl)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(getBody)
+
+	startUrl := dst.url("/v2/%s/blobs/uploads/", dstRepo)
+	startReq, err := dst.newRequest("POST", startUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	startResp, err := dst.Client.Do(startReq)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(startResp.Body)
+
+	if startResp.StatusCode != http.StatusAccepted {
+		return HttpError{startResp.Status, startUrl}
+	}
+
+	location := startResp.Header.Get("Location")
+	if location == "" {
+		return fmt.Errorf("blob upload session for %q did not return a Location header", dstRepo)
+	}
+
+	patchReq, err := dst.newRequest("PATCH", location, getBody)
+	if err != nil {
+		return err
+	}
+	patchReq.ContentLength = contentLength
+	patchReq.Header.Set("Content-Type", "application/octet-stream")
+	// getBody can only be read once, so if the destination's token
+	// expires mid-upload and authAndRetry needs to rewind this request,
+	// GetBody re-downloads the blob from the source rather than
+	// replaying an already-drained reader. This keeps the blob streaming
+	// through in the common case while still making a retry safe.
+	patchReq.GetBody = func() (io.ReadCloser, error) {
+		body, _, err := r.fetchBlob(getUrl)
+		return body, err
+	}
+
+	patchResp, err := dst.Client.Do(patchReq)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(patchResp.Body)
+
+	if patchResp.StatusCode != http.StatusAccepted {
+		return HttpError{patchResp.Status, location}
+	}
+
+	putUrl := patchResp.Header.Get("Location")
+	if putUrl == "" {
+		putUrl = location
+	}
+	putUrl = fmt.Sprintf("%s%sdigest=%s", putUrl, queryJoiner(putUrl), digest)
+
+	putReq, err := dst.newRequest("PUT", putUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	putResp, err := dst.Client.Do(putReq)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(putResp.Body)
+
+	if putResp.StatusCode != http.StatusCreated {
+		return HttpError{putResp.Status, putUrl}
+	}
+
+	return nil
+}
+
+func queryJoiner(rawUrl string) string {
+	if bytes.ContainsRune([]byte(rawUrl), '?') {
+		return "&"
+	}
+	return "?"
+}
+
+// getManifest fetches the manifest or manifest index identified by ref
+// (a tag or digest) from repo, returning its raw bytes and Content-Type.
+func (r *Registry) getManifest(repo, ref string) ([]byte, string, error) {
+	if err := r.checkAPIVersion(); err != nil {
+		return nil, "", err
+	}
+
+	sourceUrl := r.url("/v2/%s/manifests/%s", repo, ref)
+	sourceReq, err := r.newRequest("GET", sourceUrl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sourceReq.Header.Set("Accept", acceptedManifestTypes)
+	sourceResp, err := r.Client.Do(sourceReq)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(sourceResp.Body)
+
+	if sourceResp.StatusCode != http.StatusOK {
+		return nil, "", HttpError{sourceResp.Status, sourceUrl}
+	}
+
+	body, err := io.ReadAll(sourceResp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, sourceResp.Header.Get("Content-Type"), nil
+}
+
+// putManifest pushes body (of the given mediaType) to repo:ref.
+func (r *Registry) putManifest(repo, ref string, body []byte, mediaType string) error {
+	if err := r.checkAPIVersion(); err != nil {
+		return err
+	}
+
+	destUrl := r.url("/v2/%s/manifests/%s", repo, ref)
+	destReq, err := r.newRequest("PUT", destUrl, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	destReq.Header.Set("Content-Type", mediaType)
+	destResp, err := r.Client.Do(destReq)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(destResp.Body)
+
+	if destResp.StatusCode != http.StatusCreated {
+		return HttpError{destResp.Status, destUrl}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestIndexEntryRoundTrip confirms that decoding and re-encoding a
+// manifest-list entry reproduces it byte-for-byte, including fields
+// indexEntry/descriptor don't model (annotations, urls, os.version),
+// so filtering an index never silently drops them from kept entries.
+func TestIndexEntryRoundTrip(t *testing.T) {
+	const in = `{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:abc","size":123,"platform":{"architecture":"amd64","os":"windows","os.version":"10.0.17763.1879"},"annotations":{"com.example.note":"keep me"},"urls":["https://example.com/blob"]}`
+
+	var e indexEntry
+	if err := json.Unmarshal([]byte(in), &e); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	if e.Digest != "sha256:abc" {
+		t.Errorf("Digest = %q, want %q", e.Digest, "sha256:abc")
+	}
+	if e.Platform == nil || e.Platform.OS != "windows" || e.Platform.Architecture != "amd64" {
+		t.Fatalf("Platform = %+v, want os=windows arch=amd64", e.Platform)
+	}
+
+	out, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if string(out) != in {
+		t.Errorf("Marshal() = %s, want %s", out, in)
+	}
+}
+
+func TestIsManifestList(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		want      bool
+	}{
+		{dockerManifestListV2MIME, true},
+		{ociIndexV1MIME, true},
+		{dockerManifestV2MIME, false},
+		{ociManifestV1MIME, false},
+	}
+
+	for _, tt := range tests {
+		if got := isManifestList(tt.mediaType); got != tt.want {
+			t.Errorf("isManifestList(%q) = %v, want %v", tt.mediaType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials authenticates against a single registry, either as a
+// plain username/password pair or as an identity token handed back by a
+// credential helper (see tokenAuthTransport.IdentityToken).
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+// errNoCredentials is returned by a CredentialStore to say "I don't
+// have anything for this registry", so the caller moves on to the next
+// store in the chain rather than treating it as a hard failure.
+var errNoCredentials = errors.New("no credentials available")
+
+// CredentialStore resolves credentials for a registry URL. Tests can
+// inject a fake implementation instead of touching the environment or
+// the real docker config.
+type CredentialStore interface {
+	Credentials(registryUrl string) (Credentials, error)
+}
+
+// resolveCredentials tries each store in order, returning the first
+// one that has something to offer. If every store comes back empty, it
+// returns a zero Credentials (anonymous access) rather than an error,
+// matching the historical behaviour of allowing an empty user/pass.
+func resolveCredentials(stores []CredentialStore, registryUrl string) (Credentials, error) {
+	for _, store := range stores {
+		creds, err := store.Credentials(registryUrl)
+		if err == nil {
+			return creds, nil
+		}
+		if !errors.Is(err, errNoCredentials) {
+			return Credentials{}, err
+		}
+	}
+	return Credentials{}, nil
+}
+
+// envCredentialStore returns the username/password it was constructed
+// with, i.e. whatever was found in DOCKER_USER/DOCKER_PASS (or their
+// DOCKER_DEST_* counterparts).
+type envCredentialStore struct {
+	Username string
+	Password string
+}
+
+func (e envCredentialStore) Credentials(_ string) (Credentials, error) {
+	if e.Username == "" && e.Password == "" {
+		return Credentials{}, errNoCredentials
+	}
+	return Credentials{Username: e.Username, Password: e.Password}, nil
+}
+
+// dockerConfigCredentialStore resolves credentials from a docker
+// config.json. For a registry host it consults, in order, the host's
+// credHelpers entry, the host's entry under "auths" (identitytoken
+// first, then the plaintext auth), and finally the credsStore helper.
+type dockerConfigCredentialStore struct {
+	path string
+}
+
+// newDockerConfigCredentialStore points at ~/.docker/config.json, or
+// the path in the DOCKER_CONFIG env var if set.
+func newDockerConfigCredentialStore() dockerConfigCredentialStore {
+	if dir, found := os.LookupEnv("DOCKER_CONFIG"); found && dir != "" {
+		return dockerConfigCredentialStore{path: filepath.Join(dir, "config.json")}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return dockerConfigCredentialStore{}
+	}
+	return dockerConfigCredentialStore{path: filepath.Join(home, ".docker", "config.json")}
+}
+
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+func (d dockerConfigCredentialStore) Credentials(registryUrl string) (Credentials, error) {
+	if d.path == "" {
+		return Credentials{}, errNoCredentials
+	}
+
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Credentials{}, errNoCredentials
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var config dockerConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Credentials{}, fmt.Errorf("parsing %s: %w", d.path, err)
+	}
+
+	host := registryHost(registryUrl)
+
+	if helper, ok := config.CredHelpers[host]; ok && helper != "" {
+		return runCredentialHelper(helper, host)
+	}
+
+	for key, auth := range config.Auths {
+		if registryHost(key) != host {
+			continue
+		}
+		if auth.IdentityToken != "" {
+			return Credentials{IdentityToken: auth.IdentityToken}, nil
+		}
+		if auth.Auth != "" {
+			return decodeBasicAuth(auth.Auth)
+		}
+	}
+
+	if config.CredsStore != "" {
+		return runCredentialHelper(config.CredsStore, host)
+	}
+
+	return Credentials{}, errNoCredentials
+}
+
+// registryHost strips the scheme (and any trailing path, e.g. the
+// legacy Docker Hub "/v1/" suffix) off of a registry URL or config.json
+// auths key, so "https://index.docker.io/v1/" and "index.docker.io"
+// compare equal.
+func registryHost(registryUrl string) string {
+	if !strings.Contains(registryUrl, "://") {
+		registryUrl = "https://" + registryUrl
+	}
+	u, err := url.Parse(registryUrl)
+	if err != nil {
+		return registryUrl
+	}
+	return u.Host
+}
+
+func decodeBasicAuth(encoded string) (Credentials, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("decoding auth entry: %w", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return Credentials{}, errors.New("malformed auth entry, expected \"username:password\"")
+	}
+	return Credentials{Username: username, Password: password}, nil
+}
+
+// credentialHelperOutput is what `docker-credential-<helper> get`
+// writes to stdout on success.
+type credentialHelperOutput struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// runCredentialHelper shells out to docker-credential-<helper>,
+// writing host to its stdin and decoding the JSON credentials it prints
+// on stdout, per the docker-credential-helpers protocol.
+func runCredentialHelper(helper, host string) (Credentials, error) {
+	cmd := exec.Command(fmt.Sprintf("docker-credential-%s", helper), "get")
+	cmd.Stdin = strings.NewReader(host)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		return Credentials{}, fmt.Errorf("running docker-credential-%s: %w", helper, err)
+	}
+
+	var out credentialHelperOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return Credentials{}, fmt.Errorf("parsing docker-credential-%s output: %w", helper, err)
+	}
+
+	// Some helpers (e.g. osxkeychain with an identity token) return the
+	// token itself as the Secret, with a sentinel Username.
+	if out.Username == "<token>" {
+		return Credentials{IdentityToken: out.Secret}, nil
+	}
+
+	return Credentials{Username: out.Username, Password: out.Secret}, nil
+}
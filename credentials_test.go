@@ -0,0 +1,173 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeCredentialStore is a CredentialStore a test controls directly,
+// rather than touching the environment or a real docker config.
+type fakeCredentialStore struct {
+	creds Credentials
+	err   error
+}
+
+func (f fakeCredentialStore) Credentials(_ string) (Credentials, error) {
+	return f.creds, f.err
+}
+
+func TestResolveCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		stores  []CredentialStore
+		want    Credentials
+		wantErr bool
+	}{
+		{
+			name:   "no stores",
+			stores: nil,
+			want:   Credentials{},
+		},
+		{
+			name: "first store has credentials",
+			stores: []CredentialStore{
+				fakeCredentialStore{creds: Credentials{Username: "alice", Password: "hunter2"}},
+				fakeCredentialStore{creds: Credentials{Username: "bob", Password: "ignored"}},
+			},
+			want: Credentials{Username: "alice", Password: "hunter2"},
+		},
+		{
+			name: "first store empty, falls through to second",
+			stores: []CredentialStore{
+				fakeCredentialStore{err: errNoCredentials},
+				fakeCredentialStore{creds: Credentials{Username: "bob", Password: "s3cr3t"}},
+			},
+			want: Credentials{Username: "bob", Password: "s3cr3t"},
+		},
+		{
+			name: "every store empty",
+			stores: []CredentialStore{
+				fakeCredentialStore{err: errNoCredentials},
+				fakeCredentialStore{err: errNoCredentials},
+			},
+			want: Credentials{},
+		},
+		{
+			name: "a store errors hard, stops the chain",
+			stores: []CredentialStore{
+				fakeCredentialStore{err: errors.New("boom")},
+				fakeCredentialStore{creds: Credentials{Username: "unreached"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveCredentials(tt.stores, "registry.example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("resolveCredentials() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvCredentialStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   envCredentialStore
+		want    Credentials
+		wantErr error
+	}{
+		{
+			name:    "empty",
+			store:   envCredentialStore{},
+			wantErr: errNoCredentials,
+		},
+		{
+			name:  "username and password set",
+			store: envCredentialStore{Username: "alice", Password: "hunter2"},
+			want:  Credentials{Username: "alice", Password: "hunter2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.store.Credentials("registry.example.com")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Credentials() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && got != tt.want {
+				t.Errorf("Credentials() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeBasicAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		want    Credentials
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			encoded: "YWxpY2U6aHVudGVyMg==", // alice:hunter2
+			want:    Credentials{Username: "alice", Password: "hunter2"},
+		},
+		{
+			name:    "not base64",
+			encoded: "not-base64!!",
+			wantErr: true,
+		},
+		{
+			name:    "missing colon",
+			encoded: "YWxpY2U=", // alice
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeBasicAuth(tt.encoded)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeBasicAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("decodeBasicAuth() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "bare host", in: "index.docker.io", want: "index.docker.io"},
+		{name: "https url", in: "https://index.docker.io", want: "index.docker.io"},
+		{name: "legacy v1 suffix", in: "https://index.docker.io/v1/", want: "index.docker.io"},
+		{name: "host with port", in: "https://registry.example.com:5000", want: "registry.example.com:5000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := registryHost(tt.in); got != tt.want {
+				t.Errorf("registryHost(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
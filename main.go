@@ -5,21 +5,37 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"docker-retag/arguments"
+	"docker-retag/challenge"
 )
 
 const (
-	dockerRegistryEnv = "DOCKER_REGISTRY"
-	dockerUsernameEnv = "DOCKER_USER"
-	dockerPasswordEnv = "DOCKER_PASS"
+	dockerRegistryEnv     = "DOCKER_REGISTRY"
+	dockerUsernameEnv     = "DOCKER_USER"
+	dockerPasswordEnv     = "DOCKER_PASS"
+	dockerDestRegistryEnv = "DOCKER_DEST_REGISTRY"
+	dockerDestUsernameEnv = "DOCKER_DEST_USER"
+	dockerDestPasswordEnv = "DOCKER_DEST_PASS"
+
+	// dockerRetagTimeoutEnv holds a time.ParseDuration-formatted string
+	// (e.g. "30s") bounding every request made to either registry.
+	dockerRetagTimeoutEnv = "DOCKER_RETAG_TIMEOUT"
+	// dockerRetagHeadersEnv holds a comma-separated list of
+	// "Header-Name=value" pairs sent with every request, e.g. for
+	// registries behind an authenticating proxy. Headers passed via -H
+	// take precedence over this env var on a name collision.
+	dockerRetagHeadersEnv = "DOCKER_RETAG_HEADERS"
+	// dockerRetagUserAgentEnv overrides the default
+	// "docker-retag/<version>" User-Agent sent with every request.
+	dockerRetagUserAgentEnv = "DOCKER_RETAG_USER_AGENT"
 
 	defaultRegistry = "https://index.docker.io"
 
@@ -29,6 +45,11 @@ const (
 	ociIndexV1MIME           = "application/vnd.oci.image.index.v1+json"
 )
 
+// acceptedManifestTypes is sent as the Accept header on every manifest
+// GET, so the registry knows it may hand back an index/manifest list
+// rather than flattening to a single-platform manifest.
+var acceptedManifestTypes = strings.Join([]string{ociManifestV1MIME, ociIndexV1MIME, dockerManifestListV2MIME, dockerManifestV2MIME}, ", ")
+
 func main() {
 	if err := mainCmd(os.Args); err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "docker-retag: %s\n", err.Error())
@@ -41,6 +62,8 @@ func mainCmd(args []string) error {
 	username, _ := os.LookupEnv(dockerUsernameEnv)
 	password, _ := os.LookupEnv(dockerPasswordEnv)
 
+	dockerConfigStore := newDockerConfigCredentialStore()
+
 	registryUrl, found := os.LookupEnv(dockerRegistryEnv)
 	if !found || registryUrl == "" {
 		registryUrl = defaultRegistry
@@ -50,7 +73,10 @@ func mainCmd(args []string) error {
 		registryUrl = "https://" + registryUrl
 	}
 
-	prog_args := args[1:]
+	prog_args, retagOpts, cliHeaders, err := extractRetagFlags(args[1:])
+	if err != nil {
+		return err
+	}
 	if len(prog_args) < 2 {
 		return errors.New("Not enough arguments provided, 2 or 3 arguments are required")
 	}
@@ -60,9 +86,41 @@ func mainCmd(args []string) error {
 		return err
 	}
 
-	reg := NewRegistry(registryUrl, username, password)
+	opts, err := optionsFromEnv(cliHeaders)
+	if err != nil {
+		return err
+	}
+
+	creds, err := resolveCredentials([]CredentialStore{envCredentialStore{username, password}, dockerConfigStore}, registryUrl)
+	if err != nil {
+		return err
+	}
+	reg := NewRegistry(registryUrl, creds, opts...)
+	defer reg.Close()
+
+	if destRegistryUrl, found := os.LookupEnv(dockerDestRegistryEnv); found && destRegistryUrl != "" {
+		if !strings.HasPrefix(destRegistryUrl, "http://") && !strings.HasPrefix(destRegistryUrl, "https://") {
+			destRegistryUrl = "https://" + destRegistryUrl
+		}
+
+		destUsername, _ := os.LookupEnv(dockerDestUsernameEnv)
+		destPassword, _ := os.LookupEnv(dockerDestPasswordEnv)
+		destCreds, err := resolveCredentials([]CredentialStore{envCredentialStore{destUsername, destPassword}, dockerConfigStore}, destRegistryUrl)
+		if err != nil {
+			return err
+		}
+		destReg := NewRegistry(destRegistryUrl, destCreds, opts...)
+		defer destReg.Close()
 
-	err = reg.ReTag(repository, oldTag, newTag)
+		if err := reg.Copy(repository, oldTag, destReg, repository, newTag); err != nil {
+			return err
+		}
+
+		fmt.Printf("Copied %s:%s from %s to %s:%s on %s\n", repository, oldTag, registryUrl, repository, newTag, destRegistryUrl)
+		return nil
+	}
+
+	err = reg.ReTagFiltered(repository, oldTag, newTag, retagOpts)
 	if err != nil {
 		return err
 	}
@@ -77,6 +135,45 @@ func mainCmd(args []string) error {
 	return nil
 }
 
+// optionsFromEnv builds the Option list shared by every Registry
+// constructed by mainCmd, from DOCKER_RETAG_TIMEOUT / DOCKER_RETAG_HEADERS
+// / DOCKER_RETAG_USER_AGENT, merging cliHeaders (from -H) over any
+// DOCKER_RETAG_HEADERS entries with the same name.
+func optionsFromEnv(cliHeaders map[string]string) ([]Option, error) {
+	var opts []Option
+
+	if raw, found := os.LookupEnv(dockerRetagTimeoutEnv); found && raw != "" {
+		timeout, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", dockerRetagTimeoutEnv, err)
+		}
+		opts = append(opts, WithTimeout(timeout))
+	}
+
+	if raw, found := os.LookupEnv(dockerRetagUserAgentEnv); found && raw != "" {
+		opts = append(opts, WithUserAgent(raw))
+	}
+
+	headers := map[string]string{}
+	if raw, found := os.LookupEnv(dockerRetagHeadersEnv); found && raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("parsing %s: %q is not in \"Header=value\" form", dockerRetagHeadersEnv, pair)
+			}
+			headers[name] = value
+		}
+	}
+	for name, value := range cliHeaders {
+		headers[name] = value
+	}
+	if len(headers) > 0 {
+		opts = append(opts, WithExtraHeaders(headers))
+	}
+
+	return opts, nil
+}
+
 type HttpError struct {
 	Status string
 	URL    string
@@ -89,24 +186,60 @@ func (h HttpError) Error() string {
 type Registry struct {
 	URL    string
 	Client *http.Client
+
+	ctx               context.Context
+	cancel            context.CancelFunc
+	apiVersionChecked bool
 }
 
-func NewRegistry(url, username, password string) *Registry {
+// Close releases the resources (in particular, the WithTimeout
+// deadline) held by r. It is always safe to call, even without
+// WithTimeout.
+func (r *Registry) Close() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// NewRegistry builds a Registry talking to url, authenticating with
+// creds. By default every GET and HEAD request gets 3 retries with
+// backoff, and no request has a deadline; pass Options to change that.
+func NewRegistry(url string, creds Credentials, opts ...Option) *Registry {
+	cfg := newRegistryConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	ctx := context.Background()
+	var cancel context.CancelFunc
+	if cfg.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+	}
+
 	authTransport := &basicAuthTransport{
 		Wrapped: &tokenAuthTransport{
-			Wrapped:  http.DefaultTransport,
-			Username: username,
-			Password: password,
+			Wrapped: &retryTransport{
+				Wrapped:      http.DefaultTransport,
+				MaxRetries:   cfg.retries,
+				UserAgent:    cfg.userAgent,
+				ExtraHeaders: cfg.extraHeaders,
+			},
+			Username:      creds.Username,
+			Password:      creds.Password,
+			IdentityToken: creds.IdentityToken,
+			Manager:       challenge.NewManager(),
 		},
 		URL:      url,
-		Username: username,
-		Password: password,
+		Username: creds.Username,
+		Password: creds.Password,
 	}
 	r := Registry{
-		url,
-		&http.Client{
+		URL: url,
+		Client: &http.Client{
 			Transport: authTransport,
 		},
+		ctx:    ctx,
+		cancel: cancel,
 	}
 
 	return &r
@@ -119,50 +252,10 @@ func (r *Registry) url(pathTemplate string, args ...interface{}) string {
 }
 
 func (r *Registry) ReTag(repo, oldTag, newTag string) error {
-	sourceUrl := r.url("/v2/%s/manifests/%s", repo, oldTag)
-	sourceReq, err := http.NewRequest("GET", sourceUrl, nil)
+	body, mediaType, err := r.getManifest(repo, oldTag)
 	if err != nil {
 		return err
 	}
 
-	sourceReq.Header.Set("Accept", strings.Join([]string{ociManifestV1MIME, ociIndexV1MIME,dockerManifestListV2MIME, dockerManifestV2MIME}, ", "))
-	sourceResp, err := r.Client.Do(sourceReq)
-	if err != nil {
-		return err
-	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(sourceResp.Body)
-
-	if sourceResp.StatusCode != http.StatusOK {
-		return HttpError{sourceResp.Status, sourceUrl}
-	}
-
-	receivedMIME := sourceResp.Header.Get("Content-Type")
-
-	manifest, err := io.ReadAll(sourceResp.Body)
-	if err != nil {
-		return err
-	}
-
-	destUrl := r.url("/v2/%s/manifests/%s", repo, newTag)
-	destReq, err := http.NewRequest("PUT", destUrl, bytes.NewBuffer(manifest))
-	if err != nil {
-		return err
-	}
-
-	destReq.Header.Set("Content-Type", receivedMIME)
-	destResp, err := r.Client.Do(destReq)
-	if err != nil {
-		return err
-	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(destResp.Body)
-
-	if destResp.StatusCode != http.StatusCreated {
-		return HttpError{destResp.Status, destUrl}
-	}
-
-	return nil
+	return r.putManifest(repo, newTag, body, mediaType)
 }
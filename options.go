@@ -0,0 +1,134 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// version is overridden at build time via -ldflags "-X main.version=...".
+var version = "dev"
+
+const (
+	defaultRetries = 3
+	minBackoff     = 200 * time.Millisecond
+)
+
+// Option configures a Registry constructed by NewRegistry.
+type Option func(*registryConfig)
+
+// registryConfig accumulates the options passed to NewRegistry before
+// the transport chain is built.
+type registryConfig struct {
+	timeout      time.Duration
+	userAgent    string
+	retries      int
+	extraHeaders map[string]string
+}
+
+func newRegistryConfig() *registryConfig {
+	return &registryConfig{
+		userAgent: fmt.Sprintf("docker-retag/%s", version),
+		retries:   defaultRetries,
+	}
+}
+
+// WithTimeout bounds every request (and retry) made through the
+// Registry by a single context deadline, so a hung registry can't hang
+// ReTag/Copy forever.
+func WithTimeout(d time.Duration) Option {
+	return func(c *registryConfig) {
+		c.timeout = d
+	}
+}
+
+// WithUserAgent overrides the default "docker-retag/<version>" User-Agent.
+func WithUserAgent(userAgent string) Option {
+	return func(c *registryConfig) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithRetries sets how many times an idempotent request is retried on a
+// 5xx response or network error, with exponential backoff and jitter
+// between attempts. The default is 3.
+func WithRetries(n int) Option {
+	return func(c *registryConfig) {
+		c.retries = n
+	}
+}
+
+// WithExtraHeaders attaches additional headers (e.g. from a -H flag) to
+// every request made through the Registry.
+func WithExtraHeaders(headers map[string]string) Option {
+	return func(c *registryConfig) {
+		c.extraHeaders = headers
+	}
+}
+
+// retryTransport sits closest to the wire: it stamps every request with
+// the User-Agent and any extra headers, and retries idempotent (GET and
+// HEAD) requests on 5xx responses or network errors with exponential backoff
+// and jitter. Because it wraps http.DefaultTransport directly, and is
+// itself wrapped by tokenAuthTransport, the token-fetch request benefits
+// from the same retry and header treatment as everything else.
+type retryTransport struct {
+	Wrapped      http.RoundTripper
+	MaxRetries   int
+	UserAgent    string
+	ExtraHeaders map[string]string
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.UserAgent != "" {
+		req.Header.Set("User-Agent", t.UserAgent)
+	}
+	for header, value := range t.ExtraHeaders {
+		req.Header.Set(header, value)
+	}
+
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, err = t.Wrapped.RoundTrip(req)
+
+		retriable := idempotent && attempt < t.MaxRetries && (err != nil || resp.StatusCode >= http.StatusInternalServerError)
+		if !retriable {
+			return resp, err
+		}
+
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff(attempt)):
+		}
+	}
+}
+
+// backoff returns an exponentially increasing delay (starting at
+// minBackoff) with up to 50% jitter, so a thundering herd of retries
+// against the same registry doesn't retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d := minBackoff * time.Duration(1<<attempt)
+	jitter := time.Duration(rand.Int63n(int64(d) / 2))
+	return d + jitter
+}
+
+// newRequest builds a request scoped to r's context (set via
+// WithTimeout), so every call made through the Registry is cancelled
+// together when that deadline expires.
+func (r *Registry) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(r.ctx, method, url, body)
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Platform identifies the OS/architecture (and, for some architectures,
+// variant) a manifest-list entry was built for.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String renders the Platform in "os/arch[/variant]" form, as accepted
+// by --platform.
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+}
+
+// matches reports whether d was built for platform p. A p.Variant of
+// "" matches any variant of d.
+func (p Platform) matches(d *Platform) bool {
+	if d == nil {
+		return false
+	}
+	if p.OS != d.OS || p.Architecture != d.Architecture {
+		return false
+	}
+	return p.Variant == "" || p.Variant == d.Variant
+}
+
+// ParsePlatforms parses a comma-separated --platform value such as
+// "linux/amd64,linux/arm64/v8" into its component Platforms.
+func ParsePlatforms(spec string) ([]Platform, error) {
+	var platforms []Platform
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		parts := strings.Split(raw, "/")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", raw)
+		}
+		p := Platform{OS: parts[0], Architecture: parts[1]}
+		if len(parts) == 3 {
+			p.Variant = parts[2]
+		}
+		platforms = append(platforms, p)
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("invalid --platform value %q", spec)
+	}
+	return platforms, nil
+}
+
+// ReTagOptions controls the behaviour of Registry.ReTagFiltered.
+type ReTagOptions struct {
+	// Platforms, if non-empty, restricts a manifest list to only the
+	// entries matching one of these platforms.
+	Platforms []Platform
+	// CopyChildren forces child manifests to be re-fetched and
+	// re-pushed under the new tag's index, rather than simply being
+	// referenced by their existing (unchanged) digest.
+	CopyChildren bool
+	// Flatten, when filtering leaves exactly one platform, pushes that
+	// child manifest directly under newTag instead of a single-entry
+	// index referencing it. Flattening re-fetches and re-pushes the
+	// child, so it implies CopyChildren's cost for that one manifest
+	// even if CopyChildren itself is unset.
+	Flatten bool
+}
+
+// ReTagFiltered behaves like ReTag, except that when oldTag names an
+// OCI index / Docker manifest list, the manifests it references are
+// first filtered down to opts.Platforms. Child manifest digests are
+// preserved byte-exact: unless opts.CopyChildren is set, they are left
+// untouched in the registry and simply referenced from the rebuilt
+// index. When filtering leaves exactly one platform and opts.Flatten
+// is set, the index is flattened and that child manifest is pushed
+// directly under newTag instead.
+func (r *Registry) ReTagFiltered(repo, oldTag, newTag string, opts ReTagOptions) error {
+	if len(opts.Platforms) == 0 {
+		return r.ReTag(repo, oldTag, newTag)
+	}
+
+	body, mediaType, err := r.getManifest(repo, oldTag)
+	if err != nil {
+		return err
+	}
+
+	if !isManifestList(mediaType) {
+		return r.putManifest(repo, newTag, body, mediaType)
+	}
+
+	var index manifestIndex
+	if err := json.Unmarshal(body, &index); err != nil {
+		return fmt.Errorf("decoding manifest index: %w", err)
+	}
+
+	filtered := filterManifests(index.Manifests, opts.Platforms)
+	if len(filtered) == 0 {
+		return fmt.Errorf("no manifests in %s:%s match platform(s) %s", repo, oldTag, platformList(opts.Platforms))
+	}
+
+	if opts.CopyChildren {
+		for _, child := range filtered {
+			childBody, childMediaType, err := r.getManifest(repo, child.Digest)
+			if err != nil {
+				return err
+			}
+			if err := r.putManifest(repo, child.Digest, childBody, childMediaType); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.Flatten && len(filtered) == 1 {
+		childBody, childMediaType, err := r.getManifest(repo, filtered[0].Digest)
+		if err != nil {
+			return err
+		}
+		return r.putManifest(repo, newTag, childBody, childMediaType)
+	}
+
+	newIndex := manifestIndex{
+		SchemaVersion: index.SchemaVersion,
+		MediaType:     index.MediaType,
+		Manifests:     filtered,
+		Annotations:   index.Annotations,
+	}
+	newBody, err := json.Marshal(newIndex)
+	if err != nil {
+		return fmt.Errorf("encoding filtered manifest index: %w", err)
+	}
+
+	return r.putManifest(repo, newTag, newBody, mediaType)
+}
+
+// extractRetagFlags pulls --platform, --copy-children, --flatten and -H
+// out of args, returning the remaining positional arguments for
+// arguments.Parse, the ReTagOptions they described, and any extra
+// headers collected from -H (e.g. for registries behind an
+// authenticating proxy).
+func extractRetagFlags(args []string) ([]string, ReTagOptions, map[string]string, error) {
+	var opts ReTagOptions
+	var remaining []string
+	var headers map[string]string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--copy-children":
+			opts.CopyChildren = true
+		case arg == "--flatten":
+			opts.Flatten = true
+		case arg == "--platform":
+			if i+1 >= len(args) {
+				return nil, opts, nil, fmt.Errorf("--platform requires a value")
+			}
+			i++
+			platforms, err := ParsePlatforms(args[i])
+			if err != nil {
+				return nil, opts, nil, err
+			}
+			opts.Platforms = platforms
+		case strings.HasPrefix(arg, "--platform="):
+			platforms, err := ParsePlatforms(strings.TrimPrefix(arg, "--platform="))
+			if err != nil {
+				return nil, opts, nil, err
+			}
+			opts.Platforms = platforms
+		case arg == "-H":
+			if i+1 >= len(args) {
+				return nil, opts, nil, fmt.Errorf("-H requires a value")
+			}
+			i++
+			name, value, ok := strings.Cut(args[i], "=")
+			if !ok {
+				return nil, opts, nil, fmt.Errorf("-H %q is not in \"Header=value\" form", args[i])
+			}
+			if headers == nil {
+				headers = map[string]string{}
+			}
+			headers[name] = value
+		default:
+			remaining = append(remaining, arg)
+		}
+	}
+
+	return remaining, opts, headers, nil
+}
+
+// filterManifests keeps only the entries of manifests whose platform
+// matches one of wanted, preserving their original order.
+func filterManifests(manifests []indexEntry, wanted []Platform) []indexEntry {
+	var filtered []indexEntry
+	for _, m := range manifests {
+		for _, p := range wanted {
+			if p.matches(m.Platform) {
+				filtered = append(filtered, m)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func platformList(platforms []Platform) string {
+	strs := make([]string, len(platforms))
+	for i, p := range platforms {
+		strs[i] = p.String()
+	}
+	return strings.Join(strs, ", ")
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 Josh Komoroske. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParsePlatforms(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []Platform
+		wantErr bool
+	}{
+		{
+			name: "single platform",
+			spec: "linux/amd64",
+			want: []Platform{{OS: "linux", Architecture: "amd64"}},
+		},
+		{
+			name: "with variant",
+			spec: "linux/arm64/v8",
+			want: []Platform{{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		},
+		{
+			name: "multiple, mixed variants",
+			spec: "linux/amd64,linux/arm64/v8",
+			want: []Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			},
+		},
+		{
+			name: "whitespace around entries is trimmed",
+			spec: " linux/amd64 , linux/arm64 ",
+			want: []Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64"},
+			},
+		},
+		{
+			name:    "empty",
+			spec:    "",
+			wantErr: true,
+		},
+		{
+			name:    "missing architecture",
+			spec:    "linux",
+			wantErr: true,
+		},
+		{
+			name:    "too many segments",
+			spec:    "linux/arm64/v8/extra",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePlatforms(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePlatforms(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePlatforms(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Platform
+		d    *Platform
+		want bool
+	}{
+		{
+			name: "exact match",
+			p:    Platform{OS: "linux", Architecture: "amd64"},
+			d:    &Platform{OS: "linux", Architecture: "amd64"},
+			want: true,
+		},
+		{
+			name: "different arch",
+			p:    Platform{OS: "linux", Architecture: "amd64"},
+			d:    &Platform{OS: "linux", Architecture: "arm64"},
+			want: false,
+		},
+		{
+			name: "wanted variant unset matches any descriptor variant",
+			p:    Platform{OS: "linux", Architecture: "arm64"},
+			d:    &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			want: true,
+		},
+		{
+			name: "wanted variant set requires exact variant match",
+			p:    Platform{OS: "linux", Architecture: "arm64", Variant: "v7"},
+			d:    &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			want: false,
+		},
+		{
+			name: "nil descriptor platform never matches",
+			p:    Platform{OS: "linux", Architecture: "amd64"},
+			d:    nil,
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.matches(tt.d); got != tt.want {
+				t.Errorf("%+v.matches(%+v) = %v, want %v", tt.p, tt.d, got, tt.want)
+			}
+		})
+	}
+}
+
+// newIndexEntry builds an indexEntry the way json.Unmarshal would,
+// so its raw field is populated from d rather than left nil.
+func newIndexEntry(t *testing.T, d descriptor) indexEntry {
+	t.Helper()
+	raw, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("marshaling descriptor: %v", err)
+	}
+	var e indexEntry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		t.Fatalf("unmarshaling indexEntry: %v", err)
+	}
+	return e
+}
+
+func TestFilterManifests(t *testing.T) {
+	amd64 := newIndexEntry(t, descriptor{Digest: "sha256:amd64", Platform: &Platform{OS: "linux", Architecture: "amd64"}})
+	arm64 := newIndexEntry(t, descriptor{Digest: "sha256:arm64", Platform: &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}})
+	noPlatform := newIndexEntry(t, descriptor{Digest: "sha256:noplatform"})
+
+	tests := []struct {
+		name      string
+		manifests []indexEntry
+		wanted    []Platform
+		want      []indexEntry
+	}{
+		{
+			name:      "keeps only matching entries, preserving order",
+			manifests: []indexEntry{arm64, noPlatform, amd64},
+			wanted:    []Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+			want:      []indexEntry{arm64, amd64},
+		},
+		{
+			name:      "entry with no platform never matches",
+			manifests: []indexEntry{noPlatform, amd64},
+			wanted:    []Platform{{OS: "linux", Architecture: "amd64"}},
+			want:      []indexEntry{amd64},
+		},
+		{
+			name:      "nothing matches",
+			manifests: []indexEntry{amd64, arm64},
+			wanted:    []Platform{{OS: "windows", Architecture: "amd64"}},
+			want:      nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterManifests(tt.manifests, tt.wanted)
+			if len(got) != len(tt.want) {
+				t.Fatalf("filterManifests() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Digest != tt.want[i].Digest {
+					t.Errorf("filterManifests()[%d].Digest = %q, want %q", i, got[i].Digest, tt.want[i].Digest)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractRetagFlags(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantArgs    []string
+		wantOpts    ReTagOptions
+		wantHeaders map[string]string
+		wantErr     bool
+	}{
+		{
+			name:     "no flags",
+			args:     []string{"repo", "old", "new"},
+			wantArgs: []string{"repo", "old", "new"},
+		},
+		{
+			name:     "copy-children and flatten",
+			args:     []string{"--copy-children", "--flatten", "repo", "old", "new"},
+			wantArgs: []string{"repo", "old", "new"},
+			wantOpts: ReTagOptions{CopyChildren: true, Flatten: true},
+		},
+		{
+			name:     "platform with separate value",
+			args:     []string{"--platform", "linux/amd64", "repo", "old", "new"},
+			wantArgs: []string{"repo", "old", "new"},
+			wantOpts: ReTagOptions{Platforms: []Platform{{OS: "linux", Architecture: "amd64"}}},
+		},
+		{
+			name:     "platform with = form",
+			args:     []string{"--platform=linux/amd64,linux/arm64", "repo", "old", "new"},
+			wantArgs: []string{"repo", "old", "new"},
+			wantOpts: ReTagOptions{Platforms: []Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64"},
+			}},
+		},
+		{
+			name:        "repeatable -H flag",
+			args:        []string{"-H", "X-Foo=bar", "-H", "X-Baz=qux", "repo", "old", "new"},
+			wantArgs:    []string{"repo", "old", "new"},
+			wantHeaders: map[string]string{"X-Foo": "bar", "X-Baz": "qux"},
+		},
+		{
+			name:    "platform missing value",
+			args:    []string{"--platform"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid platform",
+			args:    []string{"--platform=garbage"},
+			wantErr: true,
+		},
+		{
+			name:    "-H missing value",
+			args:    []string{"-H"},
+			wantErr: true,
+		},
+		{
+			name:    "-H without = is rejected",
+			args:    []string{"-H", "X-Foo"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotArgs, gotOpts, gotHeaders, err := extractRetagFlags(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractRetagFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(gotArgs, tt.wantArgs) {
+				t.Errorf("extractRetagFlags() args = %+v, want %+v", gotArgs, tt.wantArgs)
+			}
+			if !reflect.DeepEqual(gotOpts, tt.wantOpts) {
+				t.Errorf("extractRetagFlags() opts = %+v, want %+v", gotOpts, tt.wantOpts)
+			}
+			if !reflect.DeepEqual(gotHeaders, tt.wantHeaders) {
+				t.Errorf("extractRetagFlags() headers = %+v, want %+v", gotHeaders, tt.wantHeaders)
+			}
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"time"
+
+	"docker-retag/challenge"
 )
 
 type basicAuthTransport struct {
@@ -30,9 +35,70 @@ type tokenAuthTransport struct {
 	Wrapped  http.RoundTripper
 	Username string
 	Password string
+
+	// IdentityToken, when set, is exchanged for a bearer token via the
+	// OAuth2 refresh_token grant instead of authenticating with
+	// Username/Password. This is how credential helpers hand back a
+	// Docker Hub/ACR/etc. identity token in place of a real password.
+	IdentityToken string
+
+	// Manager caches bearer challenges (per endpoint) and tokens (per
+	// service/scope), so repeated requests against the same registry
+	// don't each have to eat a 401 before authenticating.
+	Manager *challenge.Manager
+}
+
+// repositoryScopePath picks the repository name and, from the request
+// method, the scope action ("pull" or "pull,push") out of a manifest or
+// blob request path, to speculatively build the same scope the registry
+// would ask for in a 401 challenge.
+var repositoryScopePath = regexp.MustCompile(`^/v2/(.+)/(?:manifests|blobs)/`)
+
+func scopeForRequest(req *http.Request, fallback string) string {
+	m := repositoryScopePath.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return withMountScope(req, fallback)
+	}
+
+	action := "pull"
+	switch req.Method {
+	case http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete:
+		action = "pull,push"
+	}
+
+	return withMountScope(req, fmt.Sprintf("repository:%s:%s", m[1], action))
+}
+
+// withMountScope adds a "repository:<from>:pull" scope for the source
+// repository of a cross-repository blob mount (POST
+// .../blobs/uploads/?mount=<digest>&from=<repo>), alongside scope (the
+// destination repository's own pull,push scope). Without it, the token
+// we authenticate with has no pull access to the repo we're mounting
+// from, so the registry can never authorize the mount and we always
+// fall back to streaming the blob through ourselves.
+func withMountScope(req *http.Request, scope string) string {
+	from := req.URL.Query().Get("from")
+	if from == "" {
+		return scope
+	}
+
+	fromScope := fmt.Sprintf("repository:%s:pull", from)
+	if scope == "" {
+		return fromScope
+	}
+	return scope + " " + fromScope
 }
 
 func (t *tokenAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := req.URL.Scheme + "://" + req.URL.Host
+
+	if c, ok := t.Manager.ChallengeFor(endpoint); ok {
+		bc := &bearerAuthChallenge{Realm: c.Realm, Service: c.Service, Scope: scopeForRequest(req, c.Scope)}
+		if token, err := t.cachedToken(req.Context(), bc); err == nil {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		}
+	}
+
 	resp, err := t.Wrapped.RoundTrip(req)
 	if err != nil {
 		return resp, err
@@ -52,26 +118,101 @@ func (t *tokenAuthTransport) RoundTrip(req *http.Request) (*http.Response, error
 		}
 		// we have a bearerChallenge
 		_ = resp.Body.Close()
-		resp, err = t.authAndRetry(&bearerAuthChallenge{
+
+		bc := &bearerAuthChallenge{
 			Realm:   bearerChallenge.Parameters["realm"],
 			Service: bearerChallenge.Parameters["service"],
-			Scope:   bearerChallenge.Parameters["scope"],
-		}, req)
+			Scope:   withMountScope(req, bearerChallenge.Parameters["scope"]),
+		}
+		t.Manager.Record(endpoint, challenge.Challenge{Realm: bc.Realm, Service: bc.Service, Scope: bc.Scope})
 
+		resp, err = t.authAndRetry(req.Context(), bc, req)
 	}
 	return resp, err
 }
 
+// cachedToken returns a still-valid token for bc from the Manager's
+// cache, fetching a fresh one (and priming the cache) only if needed.
+func (t *tokenAuthTransport) cachedToken(ctx context.Context, bc *bearerAuthChallenge) (string, error) {
+	return t.Manager.Token(bc.Service, bc.Scope, func() (string, time.Time, error) {
+		return t.fetchToken(ctx, bc)
+	})
+}
+
 type authToken struct {
-	Token string `json:"token"`
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	// IssuedAt, combined with ExpiresIn, dates the token's expiry from
+	// when the registry issued it rather than from when its response
+	// arrived here. The resulting time is compared against the local
+	// clock, so skew between the two clocks shifts it.
+	IssuedAt time.Time `json:"issued_at"`
 }
 
-func (t *tokenAuthTransport) auth(challenge *bearerAuthChallenge) (string, *http.Response, error) {
-	realmUrl, err := url.Parse(challenge.Realm)
+// defaultTokenTTL is used when a token response omits expires_in, per
+// the distribution spec's documented default.
+const defaultTokenTTL = 5 * time.Minute
+
+// fetchToken performs the actual auth round trip for challenge,
+// returning the bearer token and the absolute time it expires at.
+func (t *tokenAuthTransport) fetchToken(ctx context.Context, bc *bearerAuthChallenge) (string, time.Time, error) {
+	realmUrl, err := url.Parse(bc.Realm)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var authRequest *http.Request
+	if t.IdentityToken != "" {
+		authRequest, err = t.identityTokenAuthRequest(ctx, realmUrl, bc)
+	} else {
+		authRequest, err = t.basicAuthRequest(ctx, realmUrl, bc)
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	client := http.Client{
+		Transport: t.Wrapped,
+	}
+
+	response, err := client.Do(authRequest)
 	if err != nil {
-		return "", nil, err
+		return "", time.Time{}, err
 	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return "", time.Time{}, HttpError{response.Status, realmUrl.String()}
+	}
+
+	var tok authToken
+	if err := json.NewDecoder(response.Body).Decode(&tok); err != nil {
+		return "", time.Time{}, err
+	}
+
+	token := tok.Token
+	if token == "" {
+		token = tok.AccessToken
+	}
+
+	ttl := defaultTokenTTL
+	if tok.ExpiresIn > 0 {
+		ttl = time.Duration(tok.ExpiresIn) * time.Second
+	}
+
+	issuedAt := tok.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+
+	return token, issuedAt.Add(ttl), nil
+}
 
+// basicAuthRequest builds the classic GET-with-basic-auth token request.
+func (t *tokenAuthTransport) basicAuthRequest(ctx context.Context, realmUrl *url.URL, challenge *bearerAuthChallenge) (*http.Request, error) {
 	q := realmUrl.Query()
 	q.Set("service", challenge.Service)
 	if challenge.Scope != "" {
@@ -79,45 +220,54 @@ func (t *tokenAuthTransport) auth(challenge *bearerAuthChallenge) (string, *http
 	}
 	realmUrl.RawQuery = q.Encode()
 
-	authRequest, err := http.NewRequest("GET", realmUrl.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", realmUrl.String(), nil)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
 	if t.Username != "" || t.Password != "" {
-		authRequest.SetBasicAuth(t.Username, t.Password)
-	}
-
-	client := http.Client{
-		Transport: t.Wrapped,
+		req.SetBasicAuth(t.Username, t.Password)
 	}
 
-	response, err := client.Do(authRequest)
-	if err != nil {
-		return "", nil, err
-	}
+	return req, nil
+}
 
-	if response.StatusCode != http.StatusOK {
-		return "", response, err
+// identityTokenAuthRequest exchanges an identity token (as returned by a
+// docker-credential helper in place of a password) for a bearer token
+// using the OAuth2 refresh_token grant.
+func (t *tokenAuthTransport) identityTokenAuthRequest(ctx context.Context, realmUrl *url.URL, challenge *bearerAuthChallenge) (*http.Request, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", t.IdentityToken)
+	form.Set("service", challenge.Service)
+	if challenge.Scope != "" {
+		form.Set("scope", challenge.Scope)
 	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(response.Body)
 
-	var authToken authToken
-	decoder := json.NewDecoder(response.Body)
-	err = decoder.Decode(&authToken)
+	req, err := http.NewRequestWithContext(ctx, "POST", realmUrl.String(), strings.NewReader(form.Encode()))
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	return authToken.Token, nil, nil
+	return req, nil
 }
 
-func (t *tokenAuthTransport) authAndRetry(challenge *bearerAuthChallenge, req *http.Request) (*http.Response, error) {
-	token, authResp, err := t.auth(challenge)
+func (t *tokenAuthTransport) authAndRetry(ctx context.Context, bc *bearerAuthChallenge, req *http.Request) (*http.Response, error) {
+	token, err := t.cachedToken(ctx, bc)
 	if err != nil {
-		return authResp, err
+		return nil, err
+	}
+
+	// req's body (if any) was already drained by the unauthorized first
+	// attempt. Rewind it via GetBody before retrying, or a write (PUT,
+	// PATCH, POST with a body) would go out empty.
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
 	}
 
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))